@@ -0,0 +1,50 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linknamegen
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// AsmArches are the GOARCH values linkname-gen generates an assembly stub
+// for, matching the set of architectures the Go toolchain supports for
+// go:linkname-bound code.
+var AsmArches = []string{
+	"amd64", "arm64", "386", "arm", "ppc64le", "s390x", "riscv64", "mips64le", "wasm",
+}
+
+// abiInternalArches are the GOARCH values on which Go 1.18+ requires the
+// ABIInternal marker on a bodyless function's TEXT directive in order for
+// the symbol to link.
+var abiInternalArches = map[string]bool{
+	"amd64": true,
+	"arm64": true,
+}
+
+// AsmStubs returns, for every arch in AsmArches, the contents of the
+// linkname_<goarch>.s file declaring a NOSPLIT stub for each name in
+// funcNames. go:linkname only rewrites the symbol a Go declaration
+// resolves to; since the bound functions have no body, the linker still
+// needs something to point at.
+//
+// It performs no I/O; the caller decides where (or whether) to write the
+// result.
+func AsmStubs(funcNames []string) map[string][]byte {
+	stubs := make(map[string][]byte, len(AsmArches))
+	for _, arch := range AsmArches {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "// Code generated by linknamegen; DO NOT EDIT.\n\n")
+		attrs := "NOSPLIT, $0-0"
+		if abiInternalArches[arch] {
+			attrs = "ABIInternal|NOSPLIT, $0"
+		}
+		for _, name := range funcNames {
+			fmt.Fprintf(&buf, "TEXT ·%s(SB), %s\n", name, attrs)
+		}
+		stubs[arch] = buf.Bytes()
+	}
+	return stubs
+}
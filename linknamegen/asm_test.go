@@ -0,0 +1,53 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linknamegen
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestAsmStubsDeterministic runs AsmStubs twice, from two different working
+// directories, with the same logical funcNames input, and checks the
+// resulting content is byte-identical - it is a pure function, but this
+// guards against a future change reintroducing CWD- or map-order-dependent
+// output.
+func TestAsmStubsDeterministic(t *testing.T) {
+	funcNames := []string{"zeta", "alpha", "mu"}
+
+	got1 := AsmStubs(append([]string(nil), funcNames...))
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	got2 := AsmStubs(append([]string(nil), funcNames...))
+
+	for _, arch := range AsmArches {
+		if !bytes.Equal(got1[arch], got2[arch]) {
+			t.Errorf("linkname_%s.s differs between invocations from different working directories:\n%s\nvs\n%s", arch, got1[arch], got2[arch])
+		}
+	}
+}
+
+func TestAsmStubsABIInternal(t *testing.T) {
+	stubs := AsmStubs([]string{"foo"})
+	if !bytes.Contains(stubs["amd64"], []byte("ABIInternal|NOSPLIT")) {
+		t.Errorf("linkname_amd64.s missing ABIInternal marker:\n%s", stubs["amd64"])
+	}
+	if bytes.Contains(stubs["386"], []byte("ABIInternal")) {
+		t.Errorf("linkname_386.s should not carry the ABIInternal marker:\n%s", stubs["386"])
+	}
+	for _, arch := range []string{"amd64", "386"} {
+		if !bytes.Contains(stubs[arch], []byte("·foo(SB)")) {
+			t.Errorf("linkname_%s.s missing TEXT entry for foo:\n%s", arch, stubs[arch])
+		}
+	}
+}
@@ -0,0 +1,481 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linknamegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
+)
+
+// Bundle loads the package described by cfg the same way Generate does, but
+// resolves each Binding to the actual function declaration in its symbol
+// package's source - found via go/packages syntax trees - instead of a
+// go:linkname directive. It copies that declaration, and every unexported
+// top-level declaration it transitively depends on, into a new
+// self-contained Go file for the target package: unexported top-level
+// names are renamed to cfg.Prefix+Name - or, if cfg.Prefix is unset, to
+// that name's own symbol package followed by "_" - to avoid colliding with
+// the target package or with each other, the way
+// golang.org/x/tools/cmd/bundle renames a bundled package's identifiers.
+// A bound method's receiver type is copied in and renamed the same way
+// even when it is exported, and an exported bound function is declared
+// under its own name; other exported names are left as ordinary selectors
+// into an import of the symbol package.
+//
+// Unlike Generate, the result does not use //go:linkname and needs no
+// accompanying assembly stub, which makes it usable on toolchains that
+// don't support go:linkname, such as TinyGo or gccgo.
+func Bundle(cfg Config) ([]byte, error) {
+	fset := cfg.Fset
+	if fset == nil {
+		fset = token.NewFileSet()
+	}
+
+	dir, patterns := resolveLoadTarget(cfg.Dir, cfg.Files)
+	pkg, err := loadPackage(dir, patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	header := cfg.Header
+	if header == "" {
+		header = "linknamegen"
+	}
+
+	srcPkgs := map[string]*packages.Package{}
+	type entry struct {
+		decl     *ast.FuncDecl
+		srcPkg   *packages.Package
+		funcName string
+	}
+	entries := make([]entry, len(cfg.Bindings))
+	for i, b := range cfg.Bindings {
+		symPath, symName := path.Split(b.Symbol)
+		symPkgPath := path.Join(symPath, strings.Split(symName, ".")[0])
+		symPkg := findSymbolPackage(pkg, symPkgPath)
+		if symPkg == nil {
+			return nil, fmt.Errorf("no such symbol: `%s`", b.Symbol)
+		}
+
+		srcPkg, ok := srcPkgs[symPkg.PkgPath]
+		if !ok {
+			srcPkg, err = loadSourcePackage(dir, symPkg.PkgPath)
+			if err != nil {
+				return nil, err
+			}
+			srcPkgs[symPkg.PkgPath] = srcPkg
+		}
+
+		fd, err := parseDef(fset, b.Def)
+		if err != nil {
+			return nil, fmt.Errorf("-def %q: %s", b.Def, err)
+		}
+		decl := findFuncDecl(srcPkg, fd.Name.Name, receiverBaseName(fd))
+		if decl == nil {
+			return nil, fmt.Errorf("-symbol %q: no matching function declaration found in %s", b.Symbol, symPkg.PkgPath)
+		}
+		entries[i] = entry{decl: decl, srcPkg: srcPkg, funcName: fd.Name.Name}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].funcName < entries[j].funcName })
+
+	bd := newBundler(cfg.Prefix)
+	for _, e := range entries {
+		if err := bd.addBoundFunc(e.srcPkg, e.decl); err != nil {
+			return nil, err
+		}
+	}
+	for _, decl := range bd.decls {
+		bd.rewrite(decl.srcPkg, decl.node)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by %q; DO NOT EDIT.\n", header)
+	fmt.Fprintf(&buf, "\n")
+	fmt.Fprintf(&buf, "package %s\n", pkg.Name)
+	for _, importPath := range sortedKeys(bd.imports) {
+		fmt.Fprintf(&buf, "import \"%s\"\n", importPath)
+	}
+	fmt.Fprintf(&buf, "\n")
+	for _, decl := range bd.decls {
+		if err := format.Node(&buf, decl.srcPkg.Fset, decl.node); err != nil {
+			return nil, fmt.Errorf("formatting %T: %w", decl.node, err)
+		}
+		fmt.Fprintf(&buf, "\n\n")
+	}
+
+	src, err := imports.Process("", buf.Bytes(), nil)
+	if err != nil {
+		// Should never happen, but can arise when developing this code.
+		// Return the unformatted source so the caller can inspect it.
+		return buf.Bytes(), fmt.Errorf("formatting generated source: %w", err)
+	}
+	return src, nil
+}
+
+// loadSourcePackage loads importPath with full type and syntax information,
+// resolved from dir the same way loadPackage resolves patterns. Unlike
+// loadPackage, which only needs the target package's own syntax, Bundle
+// also needs the syntax of the (possibly indirect) packages its Bindings'
+// symbols live in, which packages.NeedDeps does not populate.
+func loadSourcePackage(dir, importPath string) (*packages.Package, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+			packages.NeedTypes | packages.NeedTypesInfo,
+		Dir: dir,
+	}
+	pkgs, err := packages.Load(cfg, importPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading package %q: %s", importPath, err)
+	}
+	return checkLoadedPackage(pkgs, importPath)
+}
+
+// findFuncDecl returns the top-level function declaration named name in
+// srcPkg whose receiver's base type (ignoring any pointer) is named recv,
+// or nil if there is none. recv is "" for ordinary functions.
+func findFuncDecl(srcPkg *packages.Package, name, recv string) *ast.FuncDecl {
+	for _, f := range srcPkg.Syntax {
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Name.Name != name {
+				continue
+			}
+			declRecv := ""
+			if fd.Recv != nil && len(fd.Recv.List) > 0 {
+				declRecv = receiverBaseIdent(fd.Recv.List[0].Type)
+			}
+			if declRecv == recv {
+				return fd
+			}
+		}
+	}
+	return nil
+}
+
+// receiverBaseName returns the bare identifier of fd's receiver type, or ""
+// if fd has no receiver - e.g. "T" for both "func (*T) m()" and
+// "func (T) m()".
+func receiverBaseName(fd *ast.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return ""
+	}
+	return receiverBaseIdent(fd.Recv.List[0].Type)
+}
+
+// receiverBaseIdent strips the leading "*", any package qualifier ("baz.")
+// and any generic instantiation ("[P]") off a receiver type expression and
+// returns its base identifier.
+func receiverBaseIdent(e ast.Expr) string {
+	if star, ok := e.(*ast.StarExpr); ok {
+		e = star.X
+	}
+	switch t := e.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.IndexExpr:
+		return receiverBaseIdent(t.X)
+	case *ast.IndexListExpr:
+		return receiverBaseIdent(t.X)
+	}
+	return ""
+}
+
+// bundledDecl is a top-level declaration copied into the output, paired
+// with the package it was copied from - needed to resolve its identifiers
+// and to print it with the right token.FileSet.
+type bundledDecl struct {
+	node   ast.Decl
+	srcPkg *packages.Package
+}
+
+// bundler accumulates the declarations Bundle copies into the output,
+// tracking which objects must be renamed and which imports the copied code
+// ends up needing.
+type bundler struct {
+	// explicitPrefix is cfg.Prefix. If empty, prefixFor derives a default
+	// per symbol package instead of sharing one prefix across packages,
+	// so unexported names that collide across packages (e.g. two
+	// "helper" functions) don't collide again in the bundled output.
+	explicitPrefix string
+
+	seenObj  map[types.Object]bool
+	seenDecl map[ast.Decl]bool
+	rename   map[types.Object]bool
+	imports  map[string]bool
+	decls    []bundledDecl
+
+	// usedNames maps every top-level identifier the bundled output will
+	// declare to the object claiming it, so two unrelated objects that
+	// would end up declared under the same name - most commonly two
+	// Bindings naming the same exported function in different symbol
+	// packages, which collide because only unexported names are renamed
+	// by default - are caught instead of producing output with a
+	// redeclared identifier.
+	usedNames map[string]types.Object
+}
+
+func newBundler(explicitPrefix string) *bundler {
+	return &bundler{
+		explicitPrefix: explicitPrefix,
+		seenObj:        map[types.Object]bool{},
+		seenDecl:       map[ast.Decl]bool{},
+		rename:         map[types.Object]bool{},
+		imports:        map[string]bool{},
+		usedNames:      map[string]types.Object{},
+	}
+}
+
+// claimName records that obj will be declared under name in the bundled
+// output, failing if some other object already claimed that name.
+func (bd *bundler) claimName(name string, obj types.Object) error {
+	if existing, ok := bd.usedNames[name]; ok && existing != obj {
+		return fmt.Errorf("bundling %s and %s would both declare %q; rename one of the bound symbols, or bind them separately", describeObject(existing), describeObject(obj), name)
+	}
+	bd.usedNames[name] = obj
+	return nil
+}
+
+// describeObject renders obj as its fully qualified symbol, e.g.
+// "example.com/foo/bar.Hidden", for use in error messages.
+func describeObject(obj types.Object) string {
+	if pkg := obj.Pkg(); pkg != nil {
+		return pkg.Path() + "." + obj.Name()
+	}
+	return obj.Name()
+}
+
+// prefixFor returns the identifier prefix to use for names copied in from
+// srcPkg: bd.explicitPrefix if set, or srcPkg's own name followed by "_"
+// otherwise.
+func (bd *bundler) prefixFor(srcPkg *packages.Package) string {
+	if bd.explicitPrefix != "" {
+		return bd.explicitPrefix
+	}
+	return srcPkg.Name + "_"
+}
+
+// addBoundFunc queues decl - a Binding's resolved function - for copying,
+// along with its transitive unexported dependencies. If decl is a method,
+// its receiver's type is always copied in too, whether or not it is
+// exported: Go has no way to declare a method on a type from another
+// package, so the type must become locally defined regardless. If decl is
+// a plain, exported function, it keeps its bare name - that's the whole
+// point of binding to an exported symbol - but that name is claimed all
+// the same, so a second Binding whose own exported function happens to
+// share it is caught as a collision rather than silently redeclared.
+func (bd *bundler) addBoundFunc(srcPkg *packages.Package, decl *ast.FuncDecl) error {
+	if recv := receiverTypeObject(srcPkg, decl); recv != nil {
+		if err := bd.addObject(srcPkg, recv); err != nil {
+			return err
+		}
+	} else if obj := srcPkg.TypesInfo.Defs[decl.Name]; obj != nil {
+		name := decl.Name.Name
+		if !obj.Exported() {
+			bd.rename[obj] = true
+			name = bd.prefixFor(srcPkg) + obj.Name()
+		}
+		if err := bd.claimName(name, obj); err != nil {
+			return err
+		}
+	}
+	return bd.addDecl(srcPkg, decl)
+}
+
+// receiverTypeObject returns the type object decl's receiver refers to, or
+// nil if decl has no receiver.
+func receiverTypeObject(srcPkg *packages.Package, decl *ast.FuncDecl) types.Object {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return nil
+	}
+	expr := decl.Recv.List[0].Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return srcPkg.TypesInfo.Uses[t]
+	case *ast.IndexExpr:
+		if id, ok := t.X.(*ast.Ident); ok {
+			return srcPkg.TypesInfo.Uses[id]
+		}
+	case *ast.IndexListExpr:
+		if id, ok := t.X.(*ast.Ident); ok {
+			return srcPkg.TypesInfo.Uses[id]
+		}
+	}
+	return nil
+}
+
+// addDecl queues decl for copying, if it hasn't been already, and walks it
+// for further unexported package-level dependencies to queue in turn.
+func (bd *bundler) addDecl(srcPkg *packages.Package, decl ast.Decl) error {
+	if bd.seenDecl[decl] {
+		return nil
+	}
+	bd.seenDecl[decl] = true
+	bd.decls = append(bd.decls, bundledDecl{node: decl, srcPkg: srcPkg})
+
+	for _, obj := range packageLevelDeps(srcPkg, decl) {
+		if err := bd.addObject(srcPkg, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addObject queues obj's declaration - and, if obj is a type, every method
+// declared on it - for copying, and marks obj for renaming. obj is always
+// a package-level object of srcPkg: either one of its unexported
+// dependencies (found by packageLevelDeps, which never returns an exported
+// object - those are reachable as ordinary qualified identifiers and don't
+// need copying in) or a bound method's receiver type, copied in regardless
+// of its own export status.
+func (bd *bundler) addObject(srcPkg *packages.Package, obj types.Object) error {
+	if bd.seenObj[obj] {
+		return nil
+	}
+	bd.seenObj[obj] = true
+	bd.rename[obj] = true
+	if err := bd.claimName(bd.prefixFor(srcPkg)+obj.Name(), obj); err != nil {
+		return err
+	}
+
+	decl, methods := declsOf(srcPkg, obj)
+	if decl != nil {
+		if err := bd.addDecl(srcPkg, decl); err != nil {
+			return err
+		}
+	}
+	for _, m := range methods {
+		if err := bd.addDecl(srcPkg, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewrite mutates node in place: every identifier referring to an object
+// bd has decided to copy in (bd.rename) is renamed to bd.prefixFor(srcPkg)+Name;
+// every identifier referring to some other package-level object of srcPkg
+// (necessarily exported - see addObject) is turned into a qualified
+// selector into srcPkg, which is added to bd.imports; references to other
+// packages are left untouched, but still recorded in bd.imports so their
+// import isn't dropped.
+func (bd *bundler) rewrite(srcPkg *packages.Package, node ast.Decl) {
+	info := srcPkg.TypesInfo
+	astutil.Apply(node, func(c *astutil.Cursor) bool {
+		id, ok := c.Node().(*ast.Ident)
+		if !ok {
+			return true
+		}
+		if sel, ok := c.Parent().(*ast.SelectorExpr); ok && sel.Sel == id {
+			return true // field/method selector name: never touched.
+		}
+
+		if pn, ok := info.Uses[id].(*types.PkgName); ok {
+			bd.imports[pn.Imported().Path()] = true
+			return true
+		}
+
+		def, isDef := info.Defs[id]
+		obj := def
+		if obj == nil {
+			obj = info.Uses[id]
+		}
+		if obj == nil || obj.Pkg() != srcPkg.Types || obj.Parent() != srcPkg.Types.Scope() {
+			return true // not a package-level object of srcPkg: leave alone.
+		}
+		if bd.rename[obj] {
+			id.Name = bd.prefixFor(srcPkg) + obj.Name()
+			return true
+		}
+		if isDef {
+			return true // an exported top-level name being declared here.
+		}
+		bd.imports[srcPkg.PkgPath] = true
+		c.Replace(&ast.SelectorExpr{X: ast.NewIdent(srcPkg.Name), Sel: ast.NewIdent(obj.Name())})
+		return true
+	}, nil)
+}
+
+// packageLevelDeps returns the unexported, package-level objects of srcPkg
+// that node's identifiers refer to.
+func packageLevelDeps(srcPkg *packages.Package, node ast.Node) []types.Object {
+	var deps []types.Object
+	seen := map[types.Object]bool{}
+	ast.Inspect(node, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := srcPkg.TypesInfo.Uses[id]
+		if obj == nil || obj.Exported() || seen[obj] {
+			return true
+		}
+		if obj.Pkg() != srcPkg.Types || obj.Parent() != srcPkg.Types.Scope() {
+			return true
+		}
+		seen[obj] = true
+		deps = append(deps, obj)
+		return true
+	})
+	return deps
+}
+
+// declsOf returns the top-level declaration defining obj - a GenDecl for a
+// const, var or type, or a FuncDecl for a plain function - plus, if obj is
+// a type, every method declared on it.
+func declsOf(srcPkg *packages.Package, obj types.Object) (ast.Decl, []*ast.FuncDecl) {
+	var methods []*ast.FuncDecl
+	if _, ok := obj.(*types.TypeName); ok {
+		for _, f := range srcPkg.Syntax {
+			for _, decl := range f.Decls {
+				fd, ok := decl.(*ast.FuncDecl)
+				if ok && fd.Recv != nil && len(fd.Recv.List) > 0 && receiverBaseIdent(fd.Recv.List[0].Type) == obj.Name() {
+					methods = append(methods, fd)
+				}
+			}
+		}
+	}
+	for _, f := range srcPkg.Syntax {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil && srcPkg.TypesInfo.Defs[d.Name] == obj {
+					return d, methods
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.ValueSpec:
+						for _, name := range s.Names {
+							if srcPkg.TypesInfo.Defs[name] == obj {
+								return d, methods
+							}
+						}
+					case *ast.TypeSpec:
+						if srcPkg.TypesInfo.Defs[s.Name] == obj {
+							return d, methods
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil, methods
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linknamegen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestBundleInlinesUnexportedDependencies checks that Bundle copies a bound
+// method, its receiver type, and the unexported helper and constant it
+// depends on, renaming all of them, while leaving a call to an exported
+// sibling function as a qualified reference to the symbol package.
+func TestBundleInlinesUnexportedDependencies(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n",
+		"foo.go": `package foo
+
+import _ "example.com/foo/baz"
+`,
+		"baz/baz.go": `package baz
+
+type T struct{ v int }
+
+func (t *T) hiddenMethod(x int) int { return x + helper(t.v) + Exported() }
+
+func helper(x int) int { return x + magic }
+
+const magic = 7
+
+func Exported() int { return magic }
+`,
+	})
+
+	src, err := Bundle(Config{
+		Dir: dir,
+		Bindings: []Binding{
+			{Symbol: "example.com/foo/baz.(*T).hiddenMethod", Def: "func (*T) hiddenMethod(x int) int"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`import "example.com/foo/baz"`,
+		"type baz_T struct",
+		"func (t *baz_T) hiddenMethod(x int) int",
+		"func baz_helper(x int) int",
+		"const baz_magic = 7",
+		"baz.Exported()",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("bundled source missing %q; got:\n%s", want, src)
+		}
+	}
+	if strings.Contains(string(src), "go:linkname") {
+		t.Errorf("bundled source should not reference go:linkname; got:\n%s", src)
+	}
+}
+
+// TestBundleMultipleBindingsCustomPrefix checks that Bundle can pull
+// functions from several symbol packages into one file in a single
+// invocation, and that -prefix overrides the default per-package prefix.
+func TestBundleMultipleBindingsCustomPrefix(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n",
+		"foo.go": `package foo
+
+import (
+	_ "example.com/foo/bar"
+	_ "example.com/foo/baz"
+)
+`,
+		"bar/bar.go": `package bar
+
+func hidden() int { return 1 }
+`,
+		"baz/baz.go": `package baz
+
+func (t *T) hiddenMethod(x int) int { return x }
+
+type T struct{}
+`,
+	})
+
+	src, err := Bundle(Config{
+		Dir:    dir,
+		Prefix: "gen_",
+		Bindings: []Binding{
+			{Symbol: "example.com/foo/bar.hidden", Def: "func hidden() int"},
+			{Symbol: "example.com/foo/baz.(*T).hiddenMethod", Def: "func (*T) hiddenMethod(x int) int"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"func gen_hidden() int",
+		"type gen_T struct",
+		"func (t *gen_T) hiddenMethod(x int) int",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("bundled source missing %q; got:\n%s", want, src)
+		}
+	}
+}
+
+// TestBundleMultipleBindingsDefaultPrefixPerPackage checks that, with no
+// -prefix given, Bundle derives a distinct default prefix per symbol
+// package rather than sharing one across the whole invocation, so two
+// packages that happen to declare a same-named unexported helper don't
+// collide in the bundled output.
+func TestBundleMultipleBindingsDefaultPrefixPerPackage(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n",
+		"foo.go": `package foo
+
+import (
+	_ "example.com/foo/bar"
+	_ "example.com/foo/baz"
+)
+`,
+		"bar/bar.go": `package bar
+
+func HiddenBar() int { return helper() }
+
+func helper() int { return 1 }
+`,
+		"baz/baz.go": `package baz
+
+func HiddenBaz() int { return helper() }
+
+func helper() int { return 2 }
+`,
+	})
+
+	src, err := Bundle(Config{
+		Dir: dir,
+		Bindings: []Binding{
+			{Symbol: "example.com/foo/bar.HiddenBar", Def: "func HiddenBar() int"},
+			{Symbol: "example.com/foo/baz.HiddenBaz", Def: "func HiddenBaz() int"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"func bar_helper() int",
+		"func baz_helper() int",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("bundled source missing %q; got:\n%s", want, src)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "linkname_bundle.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildModule(t, dir)
+}
+
+// TestBundleCollidingExportedNames checks that Bundle rejects, rather than
+// silently redeclaring, two Bindings whose bound functions are both
+// exported under the same name in different symbol packages - unlike an
+// unexported dependency, an exported bound entry point keeps its bare
+// name, so two of them sharing one can't be told apart by a default
+// per-package prefix.
+func TestBundleCollidingExportedNames(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n",
+		"foo.go": `package foo
+
+import (
+	_ "example.com/foo/bar"
+	_ "example.com/foo/baz"
+)
+`,
+		"bar/bar.go": `package bar
+
+func Hidden() int { return 1 }
+`,
+		"baz/baz.go": `package baz
+
+func Hidden() int { return 2 }
+`,
+	})
+
+	_, err := Bundle(Config{
+		Dir: dir,
+		Bindings: []Binding{
+			{Symbol: "example.com/foo/bar.Hidden", Def: "func Hidden() int"},
+			{Symbol: "example.com/foo/baz.Hidden", Def: "func Hidden() int"},
+		},
+	})
+	if err == nil {
+		t.Fatal("Bundle: expected a collision error for two exported bindings both named Hidden, got nil")
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linknamegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"strings"
+)
+
+// parseDef parses a Binding's Def, such as
+// "func goTag(*generator.Generator) string" or
+// "func (*T) method(x int) (int, error)", into an *ast.FuncDecl.
+//
+// Splitting the string by hand, as earlier versions of this tool did,
+// breaks on anything beyond the simplest signature: receivers, variadic
+// parameters, multiple parenthesized results, generics. Parsing it as real
+// Go source handles all of that for free, and gives us an AST to extract
+// the receiver from for method-style linknames.
+func parseDef(fset *token.FileSet, def string) (*ast.FuncDecl, error) {
+	src := "package dummy\n\n" + def + " {}\n"
+	file, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, decl := range file.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok {
+			return fd, nil
+		}
+	}
+	return nil, fmt.Errorf("not a function declaration")
+}
+
+// collectQualifiers returns, in order of first appearance, the package
+// qualifiers referenced anywhere in fd's receiver, type parameters,
+// parameters and results - e.g. "generator" in *generator.Generator. The
+// receiver is included because localDecl folds it into the declaration
+// as an ordinary parameter, qualifier and all.
+func collectQualifiers(fd *ast.FuncDecl) []string {
+	return qualifiersOf(fd.Recv, fd.Type.TypeParams, fd.Type.Params, fd.Type.Results)
+}
+
+// qualifiersOf returns, in order of first appearance, the package
+// qualifiers referenced anywhere across lists - e.g. "generator" in
+// *generator.Generator.
+func qualifiersOf(lists ...*ast.FieldList) []string {
+	var quals []string
+	seen := map[string]bool{}
+	for _, list := range lists {
+		if list == nil {
+			continue
+		}
+		for _, field := range list.List {
+			ast.Inspect(field.Type, func(n ast.Node) bool {
+				sel, ok := n.(*ast.SelectorExpr)
+				if !ok {
+					return true
+				}
+				if id, ok := sel.X.(*ast.Ident); ok && !seen[id.Name] {
+					seen[id.Name] = true
+					quals = append(quals, id.Name)
+				}
+				return true
+			})
+		}
+	}
+	return quals
+}
+
+// linknameLocalName derives the first argument of the //go:linkname
+// directive for fd: its bare function name. go:linkname only ever accepts
+// a plain function declaration as its local target - never a method, local
+// or foreign - so fd's receiver, if it has one, plays no part here; see
+// localDecl for how it's folded into the declaration instead.
+func linknameLocalName(fd *ast.FuncDecl) string {
+	return fd.Name.Name
+}
+
+// localDecl renders fd as the bodyless local declaration that follows a
+// //go:linkname directive. Since go:linkname can't target a method, a Def
+// written with a receiver - "func (*baz.T) hiddenMethod(x int) int" - has
+// that receiver folded into the declaration as its first parameter
+// instead, package qualifier and all: "func hiddenMethod(t *baz.T, x int)
+// int". A qualifier there is as valid as anywhere else in Def's signature,
+// since it's now an ordinary parameter type rather than a receiver, so it
+// is left alone rather than stripped.
+//
+// A generic receiver's type parameters, e.g. the T in "*Generic[T]", are
+// promoted to the function's own type parameter list so the folded
+// declaration still type-checks.
+func localDecl(fset *token.FileSet, fd *ast.FuncDecl) (string, error) {
+	decl := *fd
+	decl.Body = nil
+	if fd.Recv != nil && len(fd.Recv.List) > 0 {
+		recv := *fd.Recv.List[0]
+		if len(recv.Names) == 0 && hasNamedParam(fd.Type.Params) {
+			// Go rejects a parameter list mixing named and unnamed
+			// fields, so an anonymous receiver needs a synthesized name
+			// here if any of the signature's other parameters have one.
+			recv.Names = []*ast.Ident{ast.NewIdent(receiverParamName(recv.Type))}
+		}
+		typ := *fd.Type
+		params := *fd.Type.Params
+		params.List = append([]*ast.Field{&recv}, params.List...)
+		typ.Params = &params
+		if tparams := receiverTypeParams(fd.Recv.List[0].Type); len(tparams) > 0 {
+			typ.TypeParams = prependTypeParams(typ.TypeParams, tparams)
+		}
+		decl.Type = &typ
+		decl.Recv = nil
+	}
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, &decl); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// hasNamedParam reports whether any field in params has a name, so
+// localDecl knows whether a folded-in anonymous receiver needs one too:
+// Go rejects a parameter list that mixes named and unnamed fields.
+func hasNamedParam(params *ast.FieldList) bool {
+	if params == nil {
+		return false
+	}
+	for _, field := range params.List {
+		if len(field.Names) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// receiverParamName derives a short parameter name from a receiver's base
+// type, e.g. "t" for "*T" or "*baz.T", falling back to "recv" for a type
+// expression with no identifiable base name.
+func receiverParamName(e ast.Expr) string {
+	if p, ok := e.(*ast.StarExpr); ok {
+		e = p.X
+	}
+	switch t := e.(type) {
+	case *ast.Ident:
+		return strings.ToLower(t.Name[:1])
+	case *ast.SelectorExpr:
+		return receiverParamName(t.Sel)
+	case *ast.IndexExpr:
+		return receiverParamName(t.X)
+	case *ast.IndexListExpr:
+		return receiverParamName(t.X)
+	}
+	return "recv"
+}
+
+// receiverTypeParams returns the type parameter identifiers a generic
+// receiver instantiates - []*ast.Ident{T} for "*Generic[T]" - so localDecl
+// can redeclare them on the function it folds that receiver into.
+func receiverTypeParams(e ast.Expr) []*ast.Ident {
+	if p, ok := e.(*ast.StarExpr); ok {
+		e = p.X
+	}
+	switch t := e.(type) {
+	case *ast.IndexExpr:
+		if id, ok := t.Index.(*ast.Ident); ok {
+			return []*ast.Ident{id}
+		}
+	case *ast.IndexListExpr:
+		var ids []*ast.Ident
+		for _, idx := range t.Indices {
+			if id, ok := idx.(*ast.Ident); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	return nil
+}
+
+// prependTypeParams adds newParams, each constrained by "any", ahead of an
+// existing type parameter list. existing is always nil in practice - a
+// receiver's own type parameters are the only ones a Def ever carries -
+// but the general form keeps this from silently discarding fd.Type's if
+// that ever changes.
+func prependTypeParams(existing *ast.FieldList, newParams []*ast.Ident) *ast.FieldList {
+	field := &ast.Field{Names: newParams, Type: ast.NewIdent("any")}
+	if existing == nil {
+		return &ast.FieldList{List: []*ast.Field{field}}
+	}
+	list := *existing
+	list.List = append([]*ast.Field{field}, list.List...)
+	return &list
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linknamegen
+
+import (
+	"go/token"
+	"reflect"
+	"testing"
+)
+
+func TestParseDef(t *testing.T) {
+	tests := []struct {
+		def       string
+		wantName  string
+		wantQuals []string
+	}{
+		{
+			def:       `func goTag(*generator.Generator, *descriptor.FieldDescriptorProto) string`,
+			wantName:  "goTag",
+			wantQuals: []string{"generator", "descriptor"},
+		},
+		{
+			def:       `func (*T) method(xs ...int) (int, error)`,
+			wantName:  "method",
+			wantQuals: nil,
+		},
+		{
+			def:       `func variadic(ss ...mypkg.Thing) []mypkg.Thing`,
+			wantName:  "variadic",
+			wantQuals: []string{"mypkg"},
+		},
+		{
+			def:       `func (*baz.T) hiddenMethod(x int) int`,
+			wantName:  "hiddenMethod",
+			wantQuals: []string{"baz"},
+		},
+		{
+			def:       `func (*baz.Generic[T]) hiddenMethod(x T) T`,
+			wantName:  "hiddenMethod",
+			wantQuals: []string{"baz"},
+		},
+	}
+	fset := token.NewFileSet()
+	for _, tt := range tests {
+		fd, err := parseDef(fset, tt.def)
+		if err != nil {
+			t.Fatalf("parseDef(%q): %s", tt.def, err)
+		}
+		if got := linknameLocalName(fd); got != tt.wantName {
+			t.Errorf("parseDef(%q): local name = %q, want %q", tt.def, got, tt.wantName)
+		}
+		if got := collectQualifiers(fd); !reflect.DeepEqual(got, tt.wantQuals) {
+			t.Errorf("parseDef(%q): qualifiers = %v, want %v", tt.def, got, tt.wantQuals)
+		}
+	}
+}
+
+func TestParseDefRejectsGarbage(t *testing.T) {
+	if _, err := parseDef(token.NewFileSet(), "not a function"); err == nil {
+		t.Fatal("parseDef: expected an error for an invalid def, got nil")
+	}
+}
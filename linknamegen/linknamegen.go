@@ -0,0 +1,308 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package linknamegen implements the generation logic behind the
+// linkname-gen command: given a target package and a set of remote
+// symbol/local definition pairs, it produces a self-contained Go source
+// file implementing the corresponding go:linkname statements.
+//
+// It is split out of the linkname-gen command itself so that other tools -
+// code generators, build plugins, go:generate pipelines that want to embed
+// this logic rather than shell out to the linkname-gen binary - can drive
+// it directly.
+package linknamegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/imports"
+)
+
+// Binding pairs a remote symbol with the local function definition it is
+// bound to.
+type Binding struct {
+	// Symbol is the fully qualified remote symbol, e.g.
+	// "github.com/gogo/protobuf/protoc-gen-gogo/generator.(*Generator).goTag".
+	Symbol string
+	// Def is the Go function signature Symbol is bound to, e.g.
+	// "func goTag(*generator.Generator) string".
+	Def string
+	// LocalName overrides the first argument of the generated
+	// //go:linkname directive. If empty, it is derived from Def: the
+	// function's bare name, for a method as well; the receiver is not
+	// part of it.
+	LocalName string
+}
+
+// Config describes a single linkname-gen invocation.
+type Config struct {
+	// Dir is the directory holding the package that the go:generate
+	// clause binding Bindings lives in. Ignored if Files is set.
+	Dir string
+	// Files, if non-empty, names the Go source files making up the
+	// package instead of loading the whole of Dir. The files must all
+	// belong to the same package.
+	Files []string
+	// Bindings are the symbol/def pairs to emit go:linkname directives
+	// for.
+	Bindings []Binding
+	// Header, if set, is embedded in the "Code generated by ..." comment
+	// at the top of the file. It defaults to "linknamegen".
+	Header string
+	// Prefix, if set, is used by Bundle instead of Generate: it is
+	// prepended to every unexported top-level identifier copied in from
+	// a Binding's symbol package. It is ignored by Generate. Defaults to
+	// the symbol package's name followed by an underscore.
+	Prefix string
+	// Fset is the token.FileSet every Binding's Def is parsed with. If
+	// nil, a new one is allocated.
+	Fset *token.FileSet
+}
+
+// Generate loads the package described by cfg, resolves and validates
+// every Binding against it, and returns the gofmt-ed source of a
+// self-contained Go file implementing the corresponding go:linkname
+// statements. It does not write anything to disk; the caller decides where
+// the result goes.
+func Generate(cfg Config) ([]byte, error) {
+	fset := cfg.Fset
+	if fset == nil {
+		fset = token.NewFileSet()
+	}
+
+	dir, patterns := resolveLoadTarget(cfg.Dir, cfg.Files)
+
+	pkg, err := loadPackage(dir, patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	header := cfg.Header
+	if header == "" {
+		header = "linknamegen"
+	}
+
+	// importSet holds every import path the generated file needs; referenced
+	// is the subset of it that some Def actually qualifies an identifier
+	// with, e.g. the "baz" in "*baz.T". A Binding whose Def never mentions
+	// its own symbol package - a plain "func Hidden() int", say - still
+	// needs that package imported for go:linkname to resolve the symbol,
+	// but nothing in the generated source refers to it by name, so it has
+	// to be imported blank like "unsafe" below or goimports' unused-import
+	// pass strips it right back out.
+	importSet := map[string]bool{}
+	referenced := map[string]bool{}
+	resolved := make([]resolvedBinding, len(cfg.Bindings))
+	for i, b := range cfg.Bindings {
+		symPath, symName := path.Split(b.Symbol)
+		symPkgPath := path.Join(symPath, strings.Split(symName, ".")[0])
+		symPkg := findSymbolPackage(pkg, symPkgPath)
+		if symPkg == nil {
+			return nil, fmt.Errorf("no such symbol: `%s`", b.Symbol)
+		}
+		importSet[symPkg.PkgPath] = true
+
+		fd, err := parseDef(fset, b.Def)
+		if err != nil {
+			return nil, fmt.Errorf("-def %q: %s", b.Def, err)
+		}
+		for _, qual := range collectQualifiers(fd) {
+			qualPkg := symPkg
+			if qual != symPkg.Name {
+				qualPkg = findPackageByName(pkg, qual)
+				if qualPkg == nil {
+					return nil, fmt.Errorf("-def %q references package %q, which is not reachable from this package's imports; did you forget an import?", b.Def, qual)
+				}
+			}
+			importSet[qualPkg.PkgPath] = true
+			// localDecl folds a receiver's qualifier straight into the
+			// rendered declaration as an ordinary parameter type, so every
+			// qualifier Def mentions - receiver included - ends up
+			// referenced by name and needs a material import.
+			referenced[qualPkg.PkgPath] = true
+		}
+
+		localName := b.LocalName
+		if localName == "" {
+			localName = linknameLocalName(fd)
+		}
+
+		decl, err := localDecl(fset, fd)
+		if err != nil {
+			return nil, fmt.Errorf("-def %q: rendering declaration: %w", b.Def, err)
+		}
+		resolved[i] = resolvedBinding{Binding: b, localName: localName, funcName: fd.Name.Name, decl: decl}
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].localName < resolved[j].localName })
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by %q; DO NOT EDIT.\n", header)
+	fmt.Fprintf(&buf, "\n")
+	fmt.Fprintf(&buf, "package %s\n", pkg.Name)
+	fmt.Fprintf(&buf, "import _ \"unsafe\"\n")
+	for _, importPath := range sortedKeys(importSet) {
+		if referenced[importPath] {
+			fmt.Fprintf(&buf, "import \"%s\"\n", importPath)
+		} else {
+			fmt.Fprintf(&buf, "import _ \"%s\"\n", importPath)
+		}
+	}
+	fmt.Fprintf(&buf, "\n")
+	for _, b := range resolved {
+		fmt.Fprintf(&buf, "//go:linkname %s %s\n", b.localName, b.Symbol)
+		fmt.Fprintf(&buf, "%s\n", b.decl)
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	src, err := imports.Process("", buf.Bytes(), nil)
+	if err != nil {
+		// Should never happen, but can arise when developing this code.
+		// Return the unformatted source so the caller can inspect it.
+		return buf.Bytes(), fmt.Errorf("formatting generated source: %w", err)
+	}
+	return src, nil
+}
+
+// resolvedBinding is a Binding paired with the data extracted from its
+// parsed Def.
+type resolvedBinding struct {
+	Binding
+	localName string // First argument to //go:linkname; always the bare function name.
+	funcName  string // Bare Go function name, the same one FuncNames returns for the assembly stub.
+	decl      string // Bodyless local declaration, with Def's receiver, if any, folded into it as a parameter.
+}
+
+// FuncNames returns the bare Go function names (without receivers) for
+// bindings, sorted, for use with AsmStubs.
+func FuncNames(bindings []Binding, fset *token.FileSet) ([]string, error) {
+	if fset == nil {
+		fset = token.NewFileSet()
+	}
+	names := make([]string, len(bindings))
+	for i, b := range bindings {
+		fd, err := parseDef(fset, b.Def)
+		if err != nil {
+			return nil, fmt.Errorf("-def %q: %s", b.Def, err)
+		}
+		names[i] = fd.Name.Name
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadPackage drives a single golang.org/x/tools/go/packages.Load call for
+// patterns, rooted at dir. This is GOPATH- and module-aware: it honors
+// go.mod (and vendor/) the same way the go command itself does, rather
+// than guessing at GOPATH layout.
+func loadPackage(dir string, patterns []string) (*packages.Package, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+			packages.NeedTypes | packages.NeedTypesInfo | packages.NeedImports | packages.NeedDeps,
+		Dir: dir,
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, fmt.Errorf("loading package %v: %s", patterns, err)
+	}
+	return checkLoadedPackage(pkgs, dir)
+}
+
+// resolveLoadTarget turns a Config's Dir/Files pair into the (dir,
+// patterns) arguments loadPackage and loadSourcePackage expect: Files, if
+// set, takes priority and is loaded file-by-file out of its containing
+// directory; otherwise the whole of Dir (or "." if unset) is loaded.
+func resolveLoadTarget(dir string, files []string) (string, []string) {
+	if len(files) > 0 {
+		dir = filepath.Dir(files[0])
+		if dir == "" {
+			dir = "."
+		}
+		patterns := make([]string, len(files))
+		for i, name := range files {
+			patterns[i] = "file=" + name
+		}
+		return dir, patterns
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return dir, []string{"."}
+}
+
+// checkLoadedPackage applies the sanity checks every packages.Load call in
+// this package needs - no errors, exactly one package, and at least one
+// buildable file - and returns that one package. desc identifies the load
+// target in error messages.
+func checkLoadedPackage(pkgs []*packages.Package, desc string) (*packages.Package, error) {
+	if packages.PrintErrors(pkgs) > 0 {
+		return nil, fmt.Errorf("%s: errors loading package", desc)
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("%s: expected exactly one package, found %d", desc, len(pkgs))
+	}
+	pkg := pkgs[0]
+	if len(pkg.Syntax) == 0 {
+		return nil, fmt.Errorf("%s: no buildable Go files", desc)
+	}
+	return pkg, nil
+}
+
+// walkImportGraph walks pkg's full import graph - following transitive
+// dependencies, not just pkg's direct imports - and returns the first
+// package for which match returns true, or nil if none does.
+//
+// Walking the whole graph (rather than only pkg.Imports) means a package
+// referenced from a Binding's Symbol or Def no longer has to be a direct
+// import of the target package: it only needs to be part of the build,
+// e.g. pulled in through a vendored dependency.
+func walkImportGraph(pkg *packages.Package, match func(*packages.Package) bool) *packages.Package {
+	seen := make(map[string]bool)
+	var walk func(p *packages.Package) *packages.Package
+	walk = func(p *packages.Package) *packages.Package {
+		if p == nil || seen[p.PkgPath] {
+			return nil
+		}
+		seen[p.PkgPath] = true
+		if match(p) {
+			return p
+		}
+		for _, imp := range p.Imports {
+			if found := walk(imp); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	return walk(pkg)
+}
+
+// findSymbolPackage looks up the package whose PkgPath is importPath in
+// pkg's import graph.
+func findSymbolPackage(pkg *packages.Package, importPath string) *packages.Package {
+	return walkImportGraph(pkg, func(p *packages.Package) bool { return p.PkgPath == importPath })
+}
+
+// findPackageByName looks up a package whose base Name is name in pkg's
+// import graph. It is used to resolve the package qualifiers referenced by
+// a Def signature, e.g. "descriptor" in *descriptor.FieldDescriptorProto.
+func findPackageByName(pkg *packages.Package, name string) *packages.Package {
+	return walkImportGraph(pkg, func(p *packages.Package) bool { return p.Name == name })
+}
@@ -0,0 +1,232 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linknamegen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates files under dir, keyed by path relative to dir, and
+// returns dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+	for name, content := range files {
+		full := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// buildModule runs "go build ./..." in dir, which must be a self-contained
+// module, and fails the test with the build's own output if it doesn't
+// compile. A substring match against generated source, as the rest of this
+// file's tests do, only checks that certain text is present; it can't
+// catch output that is syntactically fine but doesn't actually compile -
+// an invalid receiver or a name collision, say - so tests asserting that
+// Generate or Bundle produce buildable code should go through this
+// instead.
+func buildModule(t *testing.T, dir string) {
+	t.Helper()
+	cmd := exec.Command("go", "build", "./...")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build %s:\n%s", dir, out)
+	}
+}
+
+// TestLoadPackageModules loads an ordinary module-mode package.
+func TestLoadPackageModules(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n",
+		"foo.go": "package foo\n\nfunc bar() int { return 1 }\n",
+	})
+
+	pkg, err := loadPackage(dir, []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "foo" {
+		t.Errorf("name = %q, want %q", pkg.Name, "foo")
+	}
+	if pkg.PkgPath != "example.com/foo" {
+		t.Errorf("PkgPath = %q, want %q", pkg.PkgPath, "example.com/foo")
+	}
+}
+
+// TestLoadPackageGOPATH loads a package addressed purely by directory, with
+// no go.mod in sight and GO111MODULE=off, the way GOPATH-mode projects are
+// laid out and built.
+func TestLoadPackageGOPATH(t *testing.T) {
+	gopath := t.TempDir()
+	dir := writeFiles(t, filepath.Join(gopath, "src", "foo"), map[string]string{
+		"foo.go": "package foo\n\nfunc bar() int { return 1 }\n",
+	})
+	t.Setenv("GO111MODULE", "off")
+	t.Setenv("GOPATH", gopath)
+
+	pkg, err := loadPackage(dir, []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "foo" {
+		t.Errorf("name = %q, want %q", pkg.Name, "foo")
+	}
+}
+
+// TestFindSymbolPackageVendored checks that a symbol defined in a vendored,
+// transitively-imported dependency (not a direct import of the target
+// package) is still found. The importing code refers to the dependency by
+// its ordinary import path, example.com/leaf - not by its path inside
+// vendor/ - the way every vendored package is actually imported; go build
+// resolves that to vendor/example.com/leaf via vendor/modules.txt.
+func TestFindSymbolPackageVendored(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n\nrequire example.com/leaf v0.0.0\n",
+		"foo.go": `package foo
+
+import "example.com/foo/internal/mid"
+
+func bar() int { return mid.Mid() }
+`,
+		"internal/mid/mid.go": `package mid
+
+import "example.com/leaf"
+
+func Mid() int { return leaf.Leaf() }
+`,
+		"vendor/example.com/leaf/leaf.go": `package leaf
+
+func Leaf() int { return 1 }
+`,
+		"vendor/modules.txt": `# example.com/leaf v0.0.0
+## explicit
+example.com/leaf
+`,
+	})
+	t.Setenv("GOFLAGS", "-mod=vendor")
+
+	pkg, err := loadPackage(dir, []string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := findSymbolPackage(pkg, "example.com/leaf")
+	if got == nil {
+		t.Fatal("findSymbolPackage: vendored, transitive dependency not found")
+	}
+}
+
+// TestGenerateMultipleBindings checks that Generate binds several symbols
+// from the same invocation into one consolidated, deduplicated file.
+func TestGenerateMultipleBindings(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n",
+		"foo.go": `package foo
+
+import (
+	_ "example.com/foo/bar"
+	_ "example.com/foo/baz"
+)
+`,
+		"bar/bar.go": `package bar
+
+func Hidden() int { return 1 }
+`,
+		"baz/baz.go": `package baz
+
+func (t *T) hiddenMethod(x int) int { return x }
+
+type T struct{}
+`,
+	})
+
+	src, err := Generate(Config{
+		Dir: dir,
+		Bindings: []Binding{
+			{Symbol: "example.com/foo/bar.Hidden", Def: "func Hidden() int"},
+			{Symbol: "example.com/foo/baz.(*T).hiddenMethod", Def: "func (*baz.T) hiddenMethod(x int) int"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		// bar.Hidden's Def never spells out "bar", so it can only be kept
+		// alive as a blank import - a plain "\"...bar\"" import would be
+		// stripped back out as unused by the goimports pass below.
+		`_ "example.com/foo/bar"`,
+		// baz.T, by contrast, is folded into hiddenMethod's signature as
+		// an ordinary parameter type, so it needs a material import.
+		`"example.com/foo/baz"`,
+		"//go:linkname Hidden example.com/foo/bar.Hidden",
+		"//go:linkname hiddenMethod example.com/foo/baz.(*T).hiddenMethod",
+		"func hiddenMethod(t *baz.T, x int) int",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("generated source missing %q; got:\n%s", want, src)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "linkname_gen.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildModule(t, dir)
+}
+
+// TestGenerateGenericReceiver checks that Generate handles a Def whose
+// receiver is a generic type instantiation, such as "*Generic[T]", without
+// panicking: the receiver is folded into the declaration as a parameter,
+// its own type parameter promoted to the function's, the same as for an
+// ordinary receiver. It doesn't go through buildModule - a generic
+// function declared without a body is rejected by the compiler
+// regardless of what this package does, a restriction of its own that
+// has nothing to do with go:linkname.
+func TestGenerateGenericReceiver(t *testing.T) {
+	dir := writeFiles(t, t.TempDir(), map[string]string{
+		"go.mod": "module example.com/foo\n\ngo 1.18\n",
+		"foo.go": `package foo
+
+import _ "example.com/foo/baz"
+`,
+		"baz/baz.go": `package baz
+
+type Generic[T any] struct{ v T }
+
+func (g *Generic[T]) hiddenMethod(x T) T { return x }
+`,
+	})
+
+	src, err := Generate(Config{
+		Dir: dir,
+		Bindings: []Binding{
+			{
+				Symbol: "example.com/foo/baz.(*Generic[...]).hiddenMethod",
+				Def:    "func (*baz.Generic[T]) hiddenMethod(x T) T",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"//go:linkname hiddenMethod example.com/foo/baz.(*Generic[...]).hiddenMethod",
+		"func hiddenMethod[T any](g *baz.Generic[T], x T) T",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("generated source missing %q; got:\n%s", want, src)
+		}
+	}
+}
@@ -7,9 +7,10 @@
 // go:linkname statements.
 // It is designed to be used with go:generate.
 //
-// Given a remote symbol and a local function definition to bind this symbol to,
-// linkname-gen will create a new self-contained Go source file implementing
-// the right go:linkname statement with the necessary imports & boilerplate.
+// Given one or more remote symbols and the local function definitions to
+// bind them to, linkname-gen will create a new self-contained Go source
+// file implementing the right go:linkname statements with the necessary
+// imports & boilerplate.
 //
 // The file is created in the same package and directory as the package that
 // defines the go:generate clause.
@@ -20,7 +21,7 @@
 //
 //	//go:generate linkname-gen -symbol "github.com/gogo/protobuf/protoc-gen-gogo/generator.(*Generator).goTag" -def "func goTag(*generator.Generator, *generator.Descriptor, *descriptor.FieldDescriptorProto, string) string"
 //
-// a sym_linkname.go file with the following content will be created:
+// a linkname_gen.go file with the following content will be created:
 //
 //	package main
 //
@@ -31,59 +32,92 @@
 //		"github.com/gogo/protobuf/protoc-gen-gogo/generator"
 //	)
 //
-//	//go:linkname goTag github.com/gogo/protobuf/protoc-gen-gogo/generator
+//	//go:linkname goTag github.com/gogo/protobuf/protoc-gen-gogo/generator.(*Generator).goTag
 //	func goTag(*generator.Generator, *generator.Descriptor, *descriptor.FieldDescriptorProto, string) string
 //
+// -symbol and -def are repeatable: the n-th -symbol on the command line is
+// paired with the n-th -def, which lets a single
+// invocation bind as many symbols as needed from the same or different
+// foreign packages. All of the bindings are emitted into one consolidated
+// file, with duplicate package imports collapsed into one.
+//
 // With no arguments, it processes the package in the current directory.
 // Otherwise, the arguments must name a single directory holding a Go package
 // or a set of Go source files that represent a single Go package.
 //
-// The default output file is sym_linkname.go, it can be overridden with
+// The package is loaded with golang.org/x/tools/go/packages, so both GOPATH
+// and module-mode projects (including ones that vendor the package defining
+// -symbol) are supported.
+//
+// The default output file is linkname_gen.go, it can be overridden with
 // the -output flag.
+//
+// On toolchains that can't honor go:linkname - TinyGo, gccgo - pass
+// -mode=bundle instead. It resolves the same -symbol/-def pairs against
+// the remote package's actual source and copies each function, along with
+// the unexported declarations it depends on, straight into a single
+// linkname_bundle.go file: no go:linkname directive, no assembly stub.
+// Copied unexported identifiers are renamed with a prefix, by default the
+// remote package's name followed by "_", to avoid colliding with the
+// destination package;
+// -prefix overrides it.
+//
+// The generation logic itself lives in the linknamegen package, so it can
+// be embedded in other tools instead of shelling out to this binary; main
+// here is just a flag-parsing wrapper around it.
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
-	"go/ast"
-	"go/build"
-	"go/importer"
-	"go/parser"
-	"go/token"
-	"go/types"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 
-	"golang.org/x/tools/imports"
+	"github.com/znly/linkname-gen/linknamegen"
 )
 
 // -----------------------------------------------------------------------------
 
 var (
-	_symbol = flag.String(
-		"symbol", "", "name of the symbol to be bound to",
+	_symbols stringList
+	_defs    stringList
+	_output  = flag.String(
+		"output", "", "output file name; default srcdir/linkname_gen.go, or srcdir/linkname_bundle.go for -mode=bundle",
 	)
-	_def = flag.String(
-		"def", "", "definition of the function to be bound to -symbol",
+	_mode = flag.String(
+		"mode", "linkname", `generation mode: "linkname" emits //go:linkname directives plus assembly stubs; "bundle" copies each symbol's source in instead, for toolchains that don't support go:linkname`,
 	)
-	_output = flag.String(
-		"output", "", "output file name; default srcdir/<type>_string.go",
+	_prefix = flag.String(
+		"prefix", "", "identifier prefix for -mode=bundle; defaults to the symbol package's name followed by \"_\"",
 	)
 )
 
+func init() {
+	flag.Var(&_symbols, "symbol", "name of a symbol to be bound to (repeatable, paired by position with -def)")
+	flag.Var(&_defs, "def", "definition of the function to be bound to the -symbol at the same position (repeatable)")
+}
+
+// stringList is a flag.Value that collects every occurrence of the flag it
+// is bound to, in the order they appear on the command line.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 // -----------------------------------------------------------------------------
 
 // Usage is a replacement usage function for the flags package.
 func Usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "\tlinkname-gen [flags] -symbol S -def F [directory]\n")
-	fmt.Fprintf(os.Stderr, "\tlinkname-gen [flags] -symbol S -def F files... # Must be a single package\n")
+	fmt.Fprintf(os.Stderr, "\tlinkname-gen [flags] -symbol S -def F [-symbol S -def F ...] [directory]\n")
+	fmt.Fprintf(os.Stderr, "\tlinkname-gen [flags] -symbol S -def F [-symbol S -def F ...] files... # Must be a single package\n")
 	fmt.Fprintf(os.Stderr, "For more information, see:\n")
 	fmt.Fprintf(os.Stderr, "\thttp://godoc.org/github.com/znly/linkname-gen\n")
 	fmt.Fprintf(os.Stderr, "Flags:\n")
@@ -95,10 +129,17 @@ func main() {
 	log.SetPrefix("linkname-gen: ")
 	flag.Usage = Usage
 	flag.Parse()
-	if len(*_symbol) == 0 {
+	if len(_symbols) == 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
+	if len(_symbols) != len(_defs) {
+		log.Fatalf("got %d -symbol flags but %d -def flags; they must be given in pairs", len(_symbols), len(_defs))
+	}
+	bindings := make([]linknamegen.Binding, len(_symbols))
+	for i, symbol := range _symbols {
+		bindings[i] = linknamegen.Binding{Symbol: symbol, Def: _defs[i]}
+	}
 
 	// We accept either one directory or a list of files. Which do we have?
 	args := flag.Args()
@@ -107,200 +148,99 @@ func main() {
 		args = []string{"."}
 	}
 
-	// Parse the package once.
-	var (
-		dir string
-		g   Generator
-	)
+	cfg := linknamegen.Config{
+		Bindings: bindings,
+		Header:   fmt.Sprintf("linkname-gen %s", strings.Join(headerArgs(os.Args[1:]), " ")),
+		Prefix:   *_prefix,
+	}
+	var dir string
 	if len(args) == 1 && isDirectory(args[0]) {
 		dir = args[0]
-		g.parsePackageDir(args[0])
+		cfg.Dir = args[0]
 	} else {
 		dir = filepath.Dir(args[0])
-		g.parsePackageFiles(args)
+		cfg.Files = args
 	}
 
-	// Print the header and package clause.
-	g.Printf("// Code generated by \"linkname-gen %s\"; DO NOT EDIT.\n", strings.Join(os.Args[1:], " "))
-	g.Printf("\n")
-	g.Printf("package %s", g.pkg.name)
-	g.Printf("\n")
+	switch *_mode {
+	case "linkname":
+		generateLinkname(cfg, dir, bindings)
+	case "bundle":
+		generateBundle(cfg, dir)
+	default:
+		log.Fatalf("unknown -mode %q; want \"linkname\" or \"bundle\"", *_mode)
+	}
+}
 
-	deps, err := exec.Command(
-		"go", "list", "-f", `'{{join .Imports "\n"}}'`, dir,
-	).Output()
+// generateLinkname emits the go:linkname-based output: the generated file
+// itself plus one assembly stub per supported GOARCH.
+func generateLinkname(cfg linknamegen.Config, dir string, bindings []linknamegen.Binding) {
+	src, err := linknamegen.Generate(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	symPath, symPkg := path.Split(*_symbol)
-	sym := symPath + strings.Split(symPkg, ".")[0]
-	var symDep string
-	for _, dep := range bytes.Split(deps, []byte("\n")) {
-		if strings.HasSuffix(string(dep), sym) {
-			symDep = string(dep)
-			break
-		}
-	}
-	if len(symDep) <= 0 {
-		log.Fatalf("no such symbol: `%s`", *_symbol)
-	}
-	funcName := strings.Split(strings.Split(*_def, " ")[1], "(")[0]
-
-	g.Printf("import _ \"%s\"\n", "unsafe")
-	g.Printf("import \"%s\"\n", sym)
-	g.Printf("\n")
-	g.Printf("//go:linkname %s %s\n", funcName, symDep)
-	g.Printf("%s\n", *_def)
 
-	// Format the output.
-	src := g.format()
-
-	// Write to file.
 	outputName := *_output
 	if outputName == "" {
-		baseName := fmt.Sprintf("%s_linkname.go", "sym")
-		outputName = filepath.Join(dir, strings.ToLower(baseName))
+		outputName = filepath.Join(dir, "linkname_gen.go")
 	}
-	err = ioutil.WriteFile(outputName, src, 0644)
-	if err != nil {
+	if err := ioutil.WriteFile(outputName, src, 0644); err != nil {
 		log.Fatalf("writing output: %s", err)
 	}
 
-	// Write assembly stub.
-	err = ioutil.WriteFile(filepath.Join(dir, "linkname.s"), []byte(""), 0644)
-	if err != nil {
-		log.Fatalf("writing assembly stub: %s", err)
-	}
-}
-
-// -----------------------------------------------------------------------------
-
-// isDirectory reports whether the named file is a directory.
-func isDirectory(name string) bool {
-	info, err := os.Stat(name)
+	// Write one assembly stub per supported GOARCH: go:linkname needs a
+	// body for every bound function, and these declare none.
+	funcNames, err := linknamegen.FuncNames(bindings, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return info.IsDir()
-}
-
-// Generator holds the state of the analysis. Primarily used to buffer
-// the output for format.Source.
-type Generator struct {
-	buf bytes.Buffer // Accumulated output.
-	pkg *Package     // Package we are scanning.
-}
-
-func (g *Generator) Printf(format string, args ...interface{}) {
-	fmt.Fprintf(&g.buf, format, args...)
-}
-
-// File holds a single parsed file and associated data.
-type File struct {
-	pkg  *Package  // Package to which this file belongs.
-	file *ast.File // Parsed AST.
-	// These fields are reset for each type being generated.
-	symbol string // Name of the constant type.
-}
-
-type Package struct {
-	dir      string
-	name     string
-	defs     map[*ast.Ident]types.Object
-	typesPkg *types.Package
-	files    []*File
+	for arch, stub := range linknamegen.AsmStubs(funcNames) {
+		name := filepath.Join(dir, fmt.Sprintf("linkname_%s.s", arch))
+		if err := ioutil.WriteFile(name, stub, 0644); err != nil {
+			log.Fatalf("writing assembly stub: %s", err)
+		}
+	}
 }
 
-// parsePackageDir parses the package residing in the directory.
-func (g *Generator) parsePackageDir(directory string) {
-	pkg, err := build.Default.ImportDir(directory, 0)
+// generateBundle emits the -mode=bundle output: a single self-contained
+// file with no go:linkname directive and no accompanying assembly stub.
+func generateBundle(cfg linknamegen.Config, dir string) {
+	src, err := linknamegen.Bundle(cfg)
 	if err != nil {
-		log.Fatalf("cannot process directory %s: %s", directory, err)
+		log.Fatal(err)
 	}
-	var names []string
-	names = append(names, pkg.GoFiles...)
-	names = append(names, pkg.CgoFiles...)
-	// TODO: Need to think about constants in test files. Maybe write type_string_test.go
-	// in a separate pass? For later.
-	// names = append(names, pkg.TestGoFiles...) // These are also in the "foo" package.
-	names = append(names, pkg.SFiles...)
-	names = prefixDirectory(directory, names)
-	g.parsePackage(directory, names, nil)
-}
 
-// parsePackageFiles parses the package occupying the named files.
-func (g *Generator) parsePackageFiles(names []string) {
-	g.parsePackage(".", names, nil)
-}
-
-// prefixDirectory places the directory name on the beginning of each name in the list.
-func prefixDirectory(directory string, names []string) []string {
-	if directory == "." {
-		return names
+	outputName := *_output
+	if outputName == "" {
+		outputName = filepath.Join(dir, "linkname_bundle.go")
 	}
-	ret := make([]string, len(names))
-	for i, name := range names {
-		ret[i] = filepath.Join(directory, name)
+	if err := ioutil.WriteFile(outputName, src, 0644); err != nil {
+		log.Fatalf("writing output: %s", err)
 	}
-	return ret
 }
 
-// parsePackage analyzes the single package constructed from the named files.
-// If text is non-nil, it is a string to be used instead of the content of the file,
-// to be used for testing. parsePackage exits if there is an error.
-func (g *Generator) parsePackage(directory string, names []string, text interface{}) {
-	var files []*File
-	var astFiles []*ast.File
-	g.pkg = new(Package)
-	fs := token.NewFileSet()
-	for _, name := range names {
-		if !strings.HasSuffix(name, ".go") {
-			continue
-		}
-		parsedFile, err := parser.ParseFile(fs, name, text, 0)
-		if err != nil {
-			log.Fatalf("parsing package: %s: %s", name, err)
-		}
-		astFiles = append(astFiles, parsedFile)
-		files = append(files, &File{
-			file: parsedFile,
-			pkg:  g.pkg,
-		})
-	}
-	if len(astFiles) == 0 {
-		log.Fatalf("%s: no buildable Go files", directory)
-	}
-	g.pkg.name = astFiles[0].Name.Name
-	g.pkg.files = files
-	g.pkg.dir = directory
-	// Type check the package.
-	g.pkg.check(fs, astFiles)
-}
+// -----------------------------------------------------------------------------
 
-// check type-checks the package. The package must be OK to proceed.
-func (pkg *Package) check(fs *token.FileSet, astFiles []*ast.File) {
-	pkg.defs = make(map[*ast.Ident]types.Object)
-	config := types.Config{Importer: importer.Default(), FakeImportC: true}
-	info := &types.Info{
-		Defs: pkg.defs,
-	}
-	typesPkg, err := config.Check(pkg.dir, fs, astFiles, info)
+// isDirectory reports whether the named file is a directory.
+func isDirectory(name string) bool {
+	info, err := os.Stat(name)
 	if err != nil {
-		log.Fatalf("checking package: %s", err)
+		log.Fatal(err)
 	}
-	pkg.typesPkg = typesPkg
+	return info.IsDir()
 }
 
-// format returns the gofmt-ed contents of the Generator's buffer.
-func (g *Generator) format() []byte {
-	src, err := imports.Process("", g.buf.Bytes(), nil)
-	//src, err := format.Source(g.buf.Bytes())
-	if err != nil {
-		// Should never happen, but can arise when developing this code.
-		// The user can compile the output to see the error.
-		log.Printf("warning: internal error: invalid Go generated: %s", err)
-		log.Printf("warning: compile the package to analyze the error")
-		return g.buf.Bytes()
+// headerArgs returns args with any absolute path argument reduced to its
+// base name, so the "Code generated by ..." header is byte-identical
+// whether linkname-gen is invoked from e.g. /tmp/build-1234/pkg or
+// /home/user/pkg for the same logical input.
+func headerArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		if filepath.IsAbs(a) {
+			a = filepath.Base(a)
+		}
+		out[i] = a
 	}
-	return src
+	return out
 }
@@ -0,0 +1,23 @@
+// Copyright 2017 Zenly <hello@zen.ly>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestHeaderArgsStripsCWD checks that an absolute path argument - the kind
+// two invocations of linkname-gen from different working directories would
+// otherwise disagree on - is reduced to its base name in the header.
+func TestHeaderArgsStripsCWD(t *testing.T) {
+	got := headerArgs([]string{"-symbol", "pkg.Foo", filepath.Join(os.TempDir(), "build-1234", "pkg")})
+	want := []string{"-symbol", "pkg.Foo", "pkg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("headerArgs = %v, want %v", got, want)
+	}
+}